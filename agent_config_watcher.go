@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/connect/proxy"
+)
+
+// agentConfigWatchInterval is how often AgentConfigWatcher polls the agent
+// for the proxy service it's watching.
+const agentConfigWatchInterval = 5 * time.Second
+
+// AgentConfigWatcher implements ConfigWatcher by polling
+// /v1/agent/service/:id for a single proxy service, useful when conoxy
+// sidecars exactly one service and a full node_services watch is overkill.
+type AgentConfigWatcher struct {
+	client   *api.Client
+	logger   *log.Logger
+	proxyID  string
+	ch       chan *Config
+	stopChan chan struct{}
+}
+
+// NewAgentConfigWatcher polls the local agent for proxyID's service
+// registration and emits a *Config on every poll, every
+// agentConfigWatchInterval, whether or not the registration changed.
+func NewAgentConfigWatcher(client *api.Client, logger *log.Logger, proxyID string) (*AgentConfigWatcher, error) {
+	if proxyID == "" {
+		return nil, fmt.Errorf("agent config watcher requires a proxy ID")
+	}
+
+	w := &AgentConfigWatcher{
+		client:   client,
+		logger:   logger,
+		proxyID:  proxyID,
+		ch:       make(chan *Config),
+		stopChan: make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *AgentConfigWatcher) run() {
+	ticker := time.NewTicker(agentConfigWatchInterval)
+	defer ticker.Stop()
+
+	w.poll()
+	for {
+		select {
+		case <-ticker.C:
+			w.poll()
+		case <-w.stopChan:
+			return
+		}
+	}
+}
+
+func (w *AgentConfigWatcher) poll() {
+	svc, _, err := w.client.Agent().Service(w.proxyID, nil)
+	if err != nil {
+		w.logger.Printf("[ERR] agent config watcher: error fetching service %s: %s", w.proxyID, err)
+		return
+	}
+	if svc.Kind != api.ServiceKindConnectProxy {
+		w.logger.Printf("[WARN] agent config watcher: service %s is not a connect proxy", w.proxyID)
+		return
+	}
+
+	cfg := buildProxyConfig(svc, w.logger)
+	w.ch <- &Config{
+		proxyConfigs: map[string]*proxy.Config{w.proxyID: cfg},
+	}
+}
+
+// Watch implements ConfigWatcher.
+func (w *AgentConfigWatcher) Watch() <-chan *Config {
+	return w.ch
+}
+
+// Close frees watcher resources and implements io.Closer.
+func (w *AgentConfigWatcher) Close() error {
+	close(w.stopChan)
+	return nil
+}
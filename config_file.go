@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/connect/proxy"
+	"github.com/hashicorp/hcl"
+	"github.com/mitchellh/mapstructure"
+)
+
+// NewFromConfigFile returns a Proxy configured from a single static config
+// file instead of a running Consul agent's node_services catalog. This is
+// mainly useful for local development and CI, where issuing leaf certs from
+// a live cluster isn't an option: the config file's DevCAFile,
+// DevServiceCertFile and DevServiceKeyFile fields are used to build the
+// connect.Service instead of going through the agent's connect CA.
+func NewFromConfigFile(client *api.Client, filename string, logger *log.Logger) (*Proxy, error) {
+	cfg, err := ParseConfigFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %s", filename, err)
+	}
+
+	// proxy.Config carries no ID of its own (every other ConfigWatcher gets
+	// one from outside it: NodeServicesConfigWatcher from the AgentService,
+	// AgentConfigWatcher from its caller), so the proxied service name is the
+	// closest thing to a stable identity for a single-service file.
+	cw, err := NewStaticConfigWatcher(map[string]*proxy.Config{cfg.ProxiedServiceName: cfg})
+	if err != nil {
+		return nil, err
+	}
+
+	return New(client, cw, logger)
+}
+
+// NewFromConfigFileMulti returns a Proxy configured from a single static
+// config file describing several proxied services, keyed by proxy ID. Use
+// this instead of NewFromConfigFile when one conoxy process should stand in
+// for more than one proxy service in local development or CI.
+func NewFromConfigFileMulti(client *api.Client, filename string, logger *log.Logger) (*Proxy, error) {
+	cfgs, err := ParseConfigFileMulti(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %s", filename, err)
+	}
+
+	cw, err := NewStaticConfigWatcher(cfgs)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(client, cw, logger)
+}
+
+// ParseConfigFile parses a single proxy.Config out of an HCL or JSON file.
+func ParseConfigFile(filename string) (*proxy.Config, error) {
+	raw, err := decodeConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg proxy.Config
+	if err := mapstructure.Decode(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("error decoding config file %s: %s", filename, err)
+	}
+	return &cfg, nil
+}
+
+// ParseConfigFileMulti parses a file describing several proxy.Configs keyed
+// by proxy ID, for running conoxy against more than one proxied service from
+// a single static file.
+func ParseConfigFileMulti(filename string) (map[string]*proxy.Config, error) {
+	raw, err := decodeConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	cfgs := make(map[string]*proxy.Config, len(raw))
+	for id, v := range raw {
+		var cfg proxy.Config
+		if err := mapstructure.Decode(v, &cfg); err != nil {
+			return nil, fmt.Errorf("error decoding config for proxy %q in %s: %s", id, filename, err)
+		}
+		cfgs[id] = &cfg
+	}
+	return cfgs, nil
+}
+
+func decodeConfigFile(filename string) (map[string]interface{}, error) {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := hcl.Decode(&raw, string(bytes)); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// StaticConfigWatcher implements ConfigWatcher by sending a single,
+// unchanging *Config and then blocking forever. It's used when the proxy
+// configuration is coming from a static file rather than a live watch.
+type StaticConfigWatcher struct {
+	ch chan *Config
+}
+
+// NewStaticConfigWatcher creates a StaticConfigWatcher that will emit
+// proxyConfigs exactly once.
+func NewStaticConfigWatcher(proxyConfigs map[string]*proxy.Config) (*StaticConfigWatcher, error) {
+	ch := make(chan *Config, 1)
+	ch <- &Config{proxyConfigs: proxyConfigs}
+	return &StaticConfigWatcher{ch: ch}, nil
+}
+
+// Watch implements ConfigWatcher.
+func (w *StaticConfigWatcher) Watch() <-chan *Config {
+	return w.ch
+}
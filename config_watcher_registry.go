@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ConfigWatcherFactory builds a ConfigWatcher from an agent client, a
+// logger and a set of implementation-specific options (e.g. a directory to
+// watch, or a single proxy ID to poll).
+type ConfigWatcherFactory func(client *api.Client, logger *log.Logger, opts map[string]string) (ConfigWatcher, error)
+
+var configWatcherFactories = map[string]ConfigWatcherFactory{}
+
+// RegisterConfigWatcher makes a ConfigWatcher implementation selectable by
+// name through NewConfigWatcher (and the -watcher flag in main.go). Adding a
+// new configuration source only requires calling this from an init
+// function; Proxy.Serve is source-agnostic.
+func RegisterConfigWatcher(name string, factory ConfigWatcherFactory) {
+	configWatcherFactories[name] = factory
+}
+
+// NewConfigWatcher builds the named ConfigWatcher, returning an error if no
+// watcher was registered under that name.
+func NewConfigWatcher(name string, client *api.Client, logger *log.Logger, opts map[string]string) (ConfigWatcher, error) {
+	factory, ok := configWatcherFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown config watcher %q", name)
+	}
+	return factory(client, logger, opts)
+}
+
+func init() {
+	RegisterConfigWatcher("node-services", func(client *api.Client, logger *log.Logger, opts map[string]string) (ConfigWatcher, error) {
+		return NewNodeServicesConfigWatcher(client, logger)
+	})
+	RegisterConfigWatcher("file", func(client *api.Client, logger *log.Logger, opts map[string]string) (ConfigWatcher, error) {
+		return NewFileConfigWatcher(opts["dir"], logger)
+	})
+	RegisterConfigWatcher("agent", func(client *api.Client, logger *log.Logger, opts map[string]string) (ConfigWatcher, error) {
+		return NewAgentConfigWatcher(client, logger, opts["id"])
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/connect/proxy"
+	"github.com/hashicorp/hcl"
+	"github.com/mitchellh/mapstructure"
+)
+
+// metaConfigKey is the service metadata key operators can use to stash a
+// base64-encoded HCL/JSON custom config blob, for when escaping it into
+// svc.Proxy.Config through the HTTP API isn't practical.
+const metaConfigKey = "conoxy.config"
+
+// customUpstreamConfig carries per-upstream overrides found in a service's
+// custom proxy config.
+type customUpstreamConfig struct {
+	ConnectTimeoutMs int
+}
+
+// customConfig carries the operator-supplied overrides conoxy understands
+// on top of what Consul already exposes on the service registration, read
+// from svc.Proxy.Config and/or the metaConfigKey service meta entry.
+type customConfig struct {
+	Token                 string
+	LocalConnectTimeoutMs int
+	HandshakeTimeoutMs    int
+	Upstreams             map[string]customUpstreamConfig
+}
+
+// parseCustomConfig decodes svc's custom proxy config, merging
+// svc.Proxy.Config with the metaConfigKey meta entry when present (the
+// latter taking precedence since it was set most recently/explicitly).
+func parseCustomConfig(svc *api.AgentService) (*customConfig, error) {
+	raw := make(map[string]interface{}, len(svc.Proxy.Config))
+	for k, v := range svc.Proxy.Config {
+		raw[k] = v
+	}
+
+	if blob, ok := svc.Meta[metaConfigKey]; ok && blob != "" {
+		decoded, err := base64.StdEncoding.DecodeString(blob)
+		if err != nil {
+			return nil, fmt.Errorf("error base64-decoding %s meta: %s", metaConfigKey, err)
+		}
+		var fromMeta map[string]interface{}
+		if err := hcl.Decode(&fromMeta, string(decoded)); err != nil {
+			return nil, fmt.Errorf("error parsing %s meta: %s", metaConfigKey, err)
+		}
+		for k, v := range fromMeta {
+			raw[k] = v
+		}
+	}
+
+	var cfg customConfig
+	if err := mapstructure.Decode(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("error decoding custom proxy config: %s", err)
+	}
+	return &cfg, nil
+}
+
+// mergeCustomConfig applies the overrides in custom on top of cfg, which was
+// already populated from the service's standard Connect proxy registration.
+func mergeCustomConfig(cfg *proxy.Config, custom *customConfig) {
+	if custom.Token != "" {
+		cfg.Token = custom.Token
+	}
+	if custom.LocalConnectTimeoutMs != 0 {
+		cfg.PublicListener.LocalConnectTimeoutMs = custom.LocalConnectTimeoutMs
+	}
+	if custom.HandshakeTimeoutMs != 0 {
+		cfg.PublicListener.HandshakeTimeoutMs = custom.HandshakeTimeoutMs
+	}
+
+	for i := range cfg.Upstreams {
+		uc := &cfg.Upstreams[i]
+		if override, ok := custom.Upstreams[uc.DestinationName]; ok && override.ConnectTimeoutMs != 0 {
+			uc.ConnectTimeoutMs = override.ConnectTimeoutMs
+		}
+		if custom.Token == "" {
+			continue
+		}
+		// Round-tripped through the upstream's opaque Config; clientForUpstream
+		// reads this back out to build a per-upstream api.Client carrying the
+		// token, since NewUpstreamListener takes a client rather than a token.
+		if uc.Config == nil {
+			uc.Config = make(map[string]interface{})
+		}
+		uc.Config["Token"] = custom.Token
+	}
+}
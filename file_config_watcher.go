@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hashicorp/consul/connect/proxy"
+)
+
+// FileConfigWatcher implements ConfigWatcher by fsnotify-watching a
+// directory of per-service HCL/JSON config files (one file per proxy ID,
+// named <id>.hcl or <id>.json) and emitting a merged *Config every time one
+// of them changes.
+type FileConfigWatcher struct {
+	dir      string
+	logger   *log.Logger
+	watcher  *fsnotify.Watcher
+	ch       chan *Config
+	stopChan chan struct{}
+}
+
+// NewFileConfigWatcher watches dir and emits a *Config built from every
+// *.hcl/*.json file in it, re-reading the whole directory on any change.
+func NewFileConfigWatcher(dir string, logger *log.Logger) (*FileConfigWatcher, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("file config watcher requires a directory")
+	}
+
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := fsw.Add(dir); err != nil {
+		fsw.Close()
+		return nil, err
+	}
+
+	w := &FileConfigWatcher{
+		dir:      dir,
+		logger:   logger,
+		watcher:  fsw,
+		ch:       make(chan *Config),
+		stopChan: make(chan struct{}),
+	}
+
+	initial, err := w.load()
+	if err != nil {
+		fsw.Close()
+		return nil, err
+	}
+
+	go w.run(initial)
+	return w, nil
+}
+
+func (w *FileConfigWatcher) run(initial map[string]*proxy.Config) {
+	w.ch <- &Config{proxyConfigs: initial}
+
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+				continue
+			}
+			cfgs, err := w.load()
+			if err != nil {
+				w.logger.Printf("[ERR] file config watcher: error reloading %s: %s", w.dir, err)
+				continue
+			}
+			w.ch <- &Config{proxyConfigs: cfgs}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.logger.Printf("[ERR] file config watcher: %s", err)
+		case <-w.stopChan:
+			return
+		}
+	}
+}
+
+// load parses every *.hcl/*.json file in w.dir into a proxy.Config, keyed by
+// proxy ID (the file name without its extension).
+func (w *FileConfigWatcher) load() (map[string]*proxy.Config, error) {
+	entries, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cfgs := make(map[string]*proxy.Config)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		ext := filepath.Ext(entry.Name())
+		if ext != ".hcl" && ext != ".json" {
+			continue
+		}
+
+		id := strings.TrimSuffix(entry.Name(), ext)
+		path := filepath.Join(w.dir, entry.Name())
+		cfg, err := ParseConfigFile(path)
+		if err != nil {
+			w.logger.Printf("[WARN] file config watcher: error parsing %s: %s", path, err)
+			continue
+		}
+		cfgs[id] = cfg
+	}
+	return cfgs, nil
+}
+
+// Watch implements ConfigWatcher.
+func (w *FileConfigWatcher) Watch() <-chan *Config {
+	return w.ch
+}
+
+// Close frees watcher resources and implements io.Closer.
+func (w *FileConfigWatcher) Close() error {
+	close(w.stopChan)
+	return w.watcher.Close()
+}
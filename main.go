@@ -1,54 +1,82 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/lib"
 )
 
 func main() {
+	configFile := flag.String("config-file", "", "path to a static HCL/JSON config file to use instead of watching the local agent")
+	configFileMulti := flag.Bool("config-file-multi", false, "treat -config-file as describing several proxy services, keyed by proxy ID")
+	watcherName := flag.String("watcher", "node-services", "ConfigWatcher to use: node-services, file or agent")
+	watchDir := flag.String("watch-dir", "", "directory of per-service config files, for the file watcher")
+	watchID := flag.String("watch-id", "", "proxy service ID to poll, for the agent watcher")
+	register := flag.Bool("register", false, "register each proxy service being served with the local agent and maintain a TTL health check for it")
+	telemetryAddr := flag.String("telemetry-prometheus-addr", "", "address to serve Prometheus metrics on; enables a Prometheus sink when set")
+	flag.Parse()
+
 	logger := log.New(os.Stderr, "", log.LstdFlags)
 
 	client, _ := api.NewClient(api.DefaultConfig())
 
+	// The telemetry sink is process-wide and must be set up exactly once,
+	// before any service starts: every proxyState shares it, labeling its
+	// own metrics instead of re-initializing it per service.
+	if *telemetryAddr != "" {
+		if err := initPrometheusTelemetry(*telemetryAddr, logger); err != nil {
+			logger.Printf("Error starting telemetry: %s", err)
+			os.Exit(1)
+		}
+	} else if _, err := lib.InitTelemetry(lib.TelemetryConfig{}); err != nil {
+		logger.Printf("Error initializing telemetry: %s", err)
+	}
+
 	// Output this first since the config watcher below will output
 	// other information.
 	// c.UI.Output("Consul Connect proxy starting...")
 
-	// Get the proper configuration watcher
-	cfgWatcher, err := NewNodeServicesConfigWatcher(client, logger)
-	if err != nil {
-		logger.Printf("Error preparing configuration: %s", err)
-		os.Exit(1)
-	}
+	var p *Proxy
+	var err error
+	if *configFile != "" {
+		if *configFileMulti {
+			p, err = NewFromConfigFileMulti(client, *configFile, logger)
+		} else {
+			p, err = NewFromConfigFile(client, *configFile, logger)
+		}
+		if err != nil {
+			logger.Printf("Error preparing configuration from file: %s", err)
+			os.Exit(1)
+		}
+	} else {
+		// Get the proper configuration watcher
+		opts := map[string]string{"dir": *watchDir, "id": *watchID}
+		cfgWatcher, err := NewConfigWatcher(*watcherName, client, logger, opts)
+		if err != nil {
+			logger.Printf("Error preparing configuration: %s", err)
+			os.Exit(1)
+		}
 
-	p, err := New(client, cfgWatcher, logger)
-	if err != nil {
-		logger.Printf("Failed initializing proxy: %s", err)
-		os.Exit(1)
+		p, err = New(client, cfgWatcher, logger)
+		if err != nil {
+			logger.Printf("Failed initializing proxy: %s", err)
+			os.Exit(1)
+		}
 	}
 
+	p.Register = *register
+
 	// Hook the shutdownCh up to close the proxy
 	go func() {
 		<-MakeShutdownCh()
 		p.Close()
 	}()
 
-	// // Register the service if we requested it
-	// if c.register {
-	// 	monitor, err := c.registerMonitor(client)
-	// 	if err != nil {
-	// 		c.UI.Error(fmt.Sprintf("Failed initializing registration: %s", err))
-	// 		return 1
-	// 	}
-
-	// 	go monitor.Run()
-	// 	defer monitor.Close()
-	// }
-
 	// c.UI.Info("")
 	// c.UI.Output("Log data will now stream in as it occurs:\n")
 	// logGate.Flush()
@@ -3,21 +3,36 @@ package main
 import (
 	"crypto/x509"
 	"log"
+	"reflect"
+	"sync"
+	"sync/atomic"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/connect"
 	"github.com/hashicorp/consul/connect/proxy"
-	"github.com/hashicorp/consul/lib"
 )
 
 // Proxy implements the built-in connect proxy.
 type Proxy struct {
+	// Register, when true, makes the proxy register each service it
+	// serves with the local Consul agent and keep a TTL check on it. It
+	// must be set before Serve is called.
+	Register bool
+
 	client      *api.Client
 	cfgWatcher  ConfigWatcher
 	stopChan    chan struct{}
 	logger      *log.Logger
 	services    map[string]*connect.Service // the key is the serviceName (could use the same service for several instances)
+	serviceRefs map[string]int              // number of proxyStates currently referencing each service
 	proxyStates map[string]*proxyState      // the key is the serviceID (upstreams and public listener are unique)
+
+	// registerMu guards registerMonitors, which is written by Serve's own
+	// goroutine (teardownServiceProxy), by whichever goroutine calls Close,
+	// and by the background goroutine startPublicListener spawns
+	// (startRegisterMonitor).
+	registerMu       sync.Mutex
+	registerMonitors map[string]*registerMonitor // the key is the serviceID
 }
 
 // New returns a proxy with the given configuration source.
@@ -26,12 +41,14 @@ type Proxy struct {
 // Whenever a new configuration is detected, the proxy will reconfigure itself.
 func New(client *api.Client, cw ConfigWatcher, logger *log.Logger) (*Proxy, error) {
 	return &Proxy{
-		client:      client,
-		cfgWatcher:  cw,
-		stopChan:    make(chan struct{}),
-		logger:      logger,
-		services:    make(map[string]*connect.Service),
-		proxyStates: make(map[string]*proxyState),
+		client:           client,
+		cfgWatcher:       cw,
+		stopChan:         make(chan struct{}),
+		logger:           logger,
+		services:         make(map[string]*connect.Service),
+		serviceRefs:      make(map[string]int),
+		proxyStates:      make(map[string]*proxyState),
+		registerMonitors: make(map[string]*registerMonitor),
 	}, nil
 }
 
@@ -51,26 +68,167 @@ func (p *Proxy) Serve() error {
 	}
 }
 
+// runServiceProxy starts a new proxyState for id, or reconfigures the
+// already running one in place when cfg has changed.
 func (p *Proxy) runServiceProxy(id string, cfg *proxy.Config) {
-	if _, ok := p.proxyStates[id]; ok {
+	if state, ok := p.proxyStates[id]; ok {
+		p.reconfigureServiceProxy(id, state, cfg)
 		return
 	}
-	p.proxyStates[id] = &proxyState{
+	p.startServiceProxy(id, cfg)
+}
+
+func (p *Proxy) startServiceProxy(id string, cfg *proxy.Config) {
+	state := &proxyState{
 		config:    cfg,
 		upstreams: make(map[string]*proxy.Listener),
 	}
-	var err error
-	svc, ok := p.services[cfg.ProxiedServiceName]
+	p.proxyStates[id] = state
+
+	svc := p.acquireService(cfg)
+
+	// TODO: Only launch this if there's a public listener configured
+	p.startPublicListener(id, state, svc, cfg)
+
+	for _, uc := range cfg.Upstreams {
+		l := proxy.NewUpstreamListener(svc, p.clientForUpstream(uc), uc, p.logger)
+		sm := newServiceMetrics(id, uc.DestinationName, "outbound")
+		if err := p.startListener(uc.String(), l, sm, nil); err != nil {
+			p.logger.Printf("[ERR] failed to start upstream %s: %s", uc.String(), err)
+		}
+		state.upstreams[uc.String()] = l
+	}
+}
+
+// clientForUpstream returns p.client, or a clone carrying uc's per-upstream
+// ACL token (stashed in uc.Config by mergeCustomConfig) when it has one.
+func (p *Proxy) clientForUpstream(uc proxy.UpstreamConfig) *api.Client {
+	token, _ := uc.Config["Token"].(string)
+	if token == "" {
+		return p.client
+	}
+	client, err := p.client.Clone()
+	if err != nil {
+		p.logger.Printf("[ERR] failed to clone client for upstream %s token: %s", uc.String(), err)
+		return p.client
+	}
+	client.SetToken(token)
+	return client
+}
+
+// startPublicListener (re)launches state's public listener for cfg. It bumps
+// state.listenerEpoch and has the launching goroutine bail without touching
+// state.listener if a later call supersedes it (a newer rebuild, or the
+// proxyState being torn down) before waitSVC/Serve return.
+func (p *Proxy) startPublicListener(id string, state *proxyState, svc *connect.Service, cfg *proxy.Config) {
+	epoch := state.bumpListenerEpoch()
+
+	go func() {
+		waitSVC(svc)
+		l := proxy.NewPublicListener(svc, cfg.PublicListener, p.logger)
+		sm := newServiceMetrics(id, "", "inbound")
+		if err := p.startListener("public listener", l, sm, &state.listenerLive); err != nil {
+			p.logger.Printf("[ERR] failed to start public listener: %s", err)
+		}
+
+		if !state.setListenerIfCurrent(l, epoch) {
+			p.logger.Printf("[INFO] public listener for %s superseded or torn down before it came up, closing it", id)
+			l.Close()
+			return
+		}
+
+		if p.Register {
+			p.startRegisterMonitor(id, cfg, state)
+		}
+	}()
+}
+
+// startRegisterMonitor registers the proxy service id with the local agent
+// and keeps its TTL check updated until the proxyState is torn down. If id is
+// already registered, it re-registers with cfg instead of starting a second
+// monitor, so a rebuilt public listener's new bind address/port reaches the
+// catalog.
+func (p *Proxy) startRegisterMonitor(id string, cfg *proxy.Config, state *proxyState) {
+	p.registerMu.Lock()
+	defer p.registerMu.Unlock()
+	if rm, ok := p.registerMonitors[id]; ok {
+		rm.Update(cfg)
+		return
+	}
+	rm := newRegisterMonitor(p.client, p.logger, id, cfg, state)
+	p.registerMonitors[id] = rm
+	go rm.Run()
+}
+
+// reconfigureServiceProxy diffs cfg against the config last applied to state
+// and only touches the pieces that changed: the proxied service, the public
+// listener and the upstream set.
+func (p *Proxy) reconfigureServiceProxy(id string, state *proxyState, cfg *proxy.Config) {
+	old := state.config
+	if old.ProxiedServiceName != cfg.ProxiedServiceName {
+		p.logger.Printf("[INFO] proxied service for %s changed from %q to %q, rebuilding", id,
+			old.ProxiedServiceName, cfg.ProxiedServiceName)
+		p.teardownServiceProxy(id, state)
+		p.startServiceProxy(id, cfg)
+		return
+	}
+
+	svc := p.services[cfg.ProxiedServiceName]
+
+	if !reflect.DeepEqual(old.PublicListener, cfg.PublicListener) {
+		p.logger.Printf("[INFO] public listener config for %s changed, restarting", id)
+		state.closeListener()
+		p.startPublicListener(id, state, svc, cfg)
+	}
+
+	p.reconcileUpstreams(id, state, svc, cfg.Upstreams)
+	state.config = cfg
+}
+
+// reconcileUpstreams closes listeners for upstreams that are no longer
+// present in upstreams and starts listeners for the ones that were added.
+// Upstreams that didn't change are left running.
+func (p *Proxy) reconcileUpstreams(id string, state *proxyState, svc *connect.Service, upstreams []proxy.UpstreamConfig) {
+	wanted := make(map[string]proxy.UpstreamConfig, len(upstreams))
+	for _, uc := range upstreams {
+		wanted[uc.String()] = uc
+	}
+
+	for key, l := range state.upstreams {
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+		p.logger.Printf("[INFO] upstream %s for %s removed, closing", key, id)
+		l.Close()
+		delete(state.upstreams, key)
+	}
+
+	for key, uc := range wanted {
+		if _, ok := state.upstreams[key]; ok {
+			continue
+		}
+		l := proxy.NewUpstreamListener(svc, p.clientForUpstream(uc), uc, p.logger)
+		sm := newServiceMetrics(id, uc.DestinationName, "outbound")
+		if err := p.startListener(key, l, sm, nil); err != nil {
+			p.logger.Printf("[ERR] failed to start upstream %s: %s", key, err)
+		}
+		state.upstreams[key] = l
+	}
+}
+
+// acquireService returns the connect.Service for cfg.ProxiedServiceName,
+// creating it on first use, and marks it as referenced by one more
+// proxyState.
+func (p *Proxy) acquireService(cfg *proxy.Config) *connect.Service {
+	name := cfg.ProxiedServiceName
+	svc, ok := p.services[name]
 	if !ok {
+		var err error
 		svc, err = cfg.Service(p.client, p.logger)
 		if err != nil {
 			p.logger.Printf("[ERROR] cannot create service: %s", err)
 		}
-		p.services[cfg.ProxiedServiceName] = svc
-
-		if _, err = lib.InitTelemetry(cfg.Telemetry); err != nil {
-			p.logger.Printf("[ERR] proxy telemetry config error: %s", err)
-		}
+		p.services[name] = svc
 
 		waitSVC(svc)
 		p.logger.Printf("[INFO] Proxy config changed and ready to serve")
@@ -85,31 +243,42 @@ func (p *Proxy) runServiceProxy(id string, cfg *proxy.Config) {
 			p.logger.Printf("[INFO] TLS Roots   : %v", roots)
 		}
 	}
+	p.serviceRefs[name]++
+	return svc
+}
 
-	go func() {
-		waitSVC(svc)
-		// TODO: Only launch this if there's a public listener configured
-		l := proxy.NewPublicListener(svc, cfg.PublicListener, p.logger)
-		if err = p.startListener("public listener", l); err != nil {
-			p.logger.Printf("[ERR] failed to start public listener: %s", err)
-		}
-		p.proxyStates[id].listener = l
-	}()
-
-	for _, uc := range cfg.Upstreams {
-		l := proxy.NewUpstreamListener(svc, p.client, uc, p.logger)
-		if err = p.startListener(uc.String(), l); err != nil {
-			p.logger.Printf("[ERR] failed to start upstream %s: %s", uc.String(),
-				err)
-		}
-		p.proxyStates[id].upstreams[uc.String()] = l
+// releaseService drops one reference to the service previously returned by
+// acquireService, closing and removing it once no proxyState references it
+// anymore.
+func (p *Proxy) releaseService(name string) {
+	p.serviceRefs[name]--
+	if p.serviceRefs[name] > 0 {
+		return
+	}
+	delete(p.serviceRefs, name)
+	if svc, ok := p.services[name]; ok {
+		p.logger.Printf("[INFO] service %s is going to be stop and removed", name)
+		svc.Close()
+		delete(p.services, name)
 	}
 }
 
-// startPublicListener is run from the internal state machine loop
-func (p *Proxy) startListener(name string, l *proxy.Listener) error {
+// startListener is run from the internal state machine loop. live, when
+// non-nil, is atomically set to 1 just before l's Serve is launched (before
+// it has bound its address) and back to 0 as soon as Serve returns, so
+// callers can tell a bind/accept failure apart from a listener that's merely
+// present but dead.
+func (p *Proxy) startListener(name string, l *proxy.Listener, sm serviceMetrics, live *int32) error {
 	p.logger.Printf("[INFO] %s starting on %s", name, l.BindAddr())
+	sm.listenerStarted()
+	if live != nil {
+		atomic.StoreInt32(live, 1)
+	}
 	go func() {
+		defer sm.listenerStopped()
+		if live != nil {
+			defer atomic.StoreInt32(live, 0)
+		}
 		if err := l.Serve(); err != nil {
 			p.logger.Printf("[ERR] %s stopped with error: %s", name, err)
 			return
@@ -135,31 +304,36 @@ func (p *Proxy) removedProxies(new map[string]*proxy.Config) map[string]*proxySt
 	return sc
 }
 
-func (p *Proxy) removedServices(new map[string]*proxy.Config) map[string]*connect.Service {
-	sc := make(map[string]*connect.Service)
-	for k, v := range p.services {
-		sc[k] = v
+// teardownServiceProxy closes the public listener and all upstream
+// listeners for state, removes it from proxyStates and releases its
+// reference on the underlying connect.Service.
+func (p *Proxy) teardownServiceProxy(id string, state *proxyState) {
+	p.registerMu.Lock()
+	if rm, ok := p.registerMonitors[id]; ok {
+		if err := rm.Close(); err != nil {
+			p.logger.Printf("[ERR] %s", err)
+		}
+		delete(p.registerMonitors, id)
 	}
-	for _, v := range new {
-		delete(sc, v.ProxiedServiceName)
+	p.registerMu.Unlock()
+
+	// Bump the epoch first so a public listener rebuild still in flight
+	// (blocked in waitSVC) bails instead of assigning a listener to a
+	// proxyState nothing will ever close again.
+	state.bumpListenerEpoch()
+	// TODO: only stop if set (could be a service without a port)
+	state.closeListener()
+	for _, u := range state.upstreams {
+		u.Close()
 	}
-	return sc
+	delete(p.proxyStates, id)
+	p.releaseService(state.config.ProxiedServiceName)
 }
 
 func (p *Proxy) removeNotPresent(new map[string]*proxy.Config) {
 	for id, state := range p.removedProxies(new) {
-		// TODO: only stop if set (could be a service without a port)
 		p.logger.Printf("[INFO] listener for service %s is going to be stop and removed", id)
-		state.listener.Close()
-		for _, u := range state.upstreams {
-			u.Close()
-		}
-		delete(p.proxyStates, id)
-	}
-	for name, service := range p.removedServices(new) {
-		p.logger.Printf("[INFO] service %s is going to be stop and removed", name)
-		service.Close()
-		delete(p.services, name)
+		p.teardownServiceProxy(id, state)
 	}
 }
 
@@ -167,6 +341,14 @@ func (p *Proxy) removeNotPresent(new map[string]*proxy.Config) {
 // called only once.
 func (p *Proxy) Close() {
 	close(p.stopChan)
+	p.registerMu.Lock()
+	for id, rm := range p.registerMonitors {
+		if err := rm.Close(); err != nil {
+			p.logger.Printf("[ERR] %s", err)
+		}
+		delete(p.registerMonitors, id)
+	}
+	p.registerMu.Unlock()
 	for _, svc := range p.services {
 		svc.Close()
 	}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/connect/proxy"
+)
+
+const (
+	// registerCheckTTL is how long the agent will wait between updates
+	// before marking a proxy's registration critical.
+	registerCheckTTL = 30 * time.Second
+	// registerCheckUpdateInterval is how often registerMonitor refreshes
+	// the TTL check, comfortably inside registerCheckTTL.
+	registerCheckUpdateInterval = 10 * time.Second
+)
+
+// registerMonitor registers a single proxy service with the local Consul
+// agent and keeps its TTL health check in sync with whether the proxy's
+// public listener is actually accepting connections.
+type registerMonitor struct {
+	client     *api.Client
+	logger     *log.Logger
+	id         string
+	cfg        *proxy.Config
+	state      *proxyState
+	stopChan   chan struct{}
+	updateChan chan *proxy.Config
+}
+
+// newRegisterMonitor creates a registerMonitor for the proxy service id. Run
+// must be called to register it and start passing/failing its health check.
+func newRegisterMonitor(client *api.Client, logger *log.Logger, id string, cfg *proxy.Config, state *proxyState) *registerMonitor {
+	return &registerMonitor{
+		client:     client,
+		logger:     logger,
+		id:         id,
+		cfg:        cfg,
+		state:      state,
+		stopChan:   make(chan struct{}),
+		updateChan: make(chan *proxy.Config),
+	}
+}
+
+// Run registers the proxy service and updates its TTL check until Close is
+// called. It's meant to be run in its own goroutine.
+func (m *registerMonitor) Run() {
+	registered := false
+	if err := m.register(); err != nil {
+		m.logger.Printf("[ERR] failed to register proxy %s: %s", m.id, err)
+	} else {
+		registered = true
+		m.logger.Printf("[INFO] proxy %s registered with the local agent", m.id)
+		m.updateCheck()
+	}
+
+	ticker := time.NewTicker(registerCheckUpdateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case cfg := <-m.updateChan:
+			m.cfg = cfg
+			if err := m.register(); err != nil {
+				m.logger.Printf("[ERR] failed to re-register proxy %s: %s", m.id, err)
+			} else {
+				registered = true
+			}
+		case <-ticker.C:
+			if !registered {
+				if err := m.register(); err != nil {
+					m.logger.Printf("[ERR] failed to register proxy %s: %s", m.id, err)
+					continue
+				}
+				registered = true
+				m.logger.Printf("[INFO] proxy %s registered with the local agent", m.id)
+			}
+			m.updateCheck()
+		case <-m.stopChan:
+			return
+		}
+	}
+}
+
+// Update re-registers the proxy service with cfg, picking up any change to
+// e.g. the public listener's bind address/port.
+func (m *registerMonitor) Update(cfg *proxy.Config) {
+	select {
+	case m.updateChan <- cfg:
+	case <-m.stopChan:
+	}
+}
+
+func (m *registerMonitor) register() error {
+	reg := &api.AgentServiceRegistration{
+		Kind:    api.ServiceKindConnectProxy,
+		ID:      m.id,
+		Name:    m.cfg.ProxiedServiceName + "-proxy",
+		Address: m.cfg.PublicListener.BindAddress,
+		Port:    m.cfg.PublicListener.BindPort,
+		Proxy: &api.AgentServiceConnectProxyConfig{
+			DestinationServiceName: m.cfg.ProxiedServiceName,
+		},
+		Check: &api.AgentServiceCheck{
+			TTL:                            registerCheckTTL.String(),
+			Notes:                          "conoxy public listener liveness",
+			DeregisterCriticalServiceAfter: "1h",
+		},
+	}
+	return m.client.Agent().ServiceRegister(reg)
+}
+
+// updateCheck passes or fails the TTL check depending on whether the public
+// listener for this proxy is actually live, i.e. its Serve loop is still
+// running, rather than merely whether a listener has been assigned.
+func (m *registerMonitor) updateCheck() {
+	checkID := "service:" + m.id
+	if atomic.LoadInt32(&m.state.listenerLive) == 1 {
+		if err := m.client.Agent().UpdateTTL(checkID, "public listener accepting connections", api.HealthPassing); err != nil {
+			m.logger.Printf("[ERR] failed to update TTL check for proxy %s: %s", m.id, err)
+		}
+		return
+	}
+	if err := m.client.Agent().UpdateTTL(checkID, "public listener not ready", api.HealthCritical); err != nil {
+		m.logger.Printf("[ERR] failed to update TTL check for proxy %s: %s", m.id, err)
+	}
+}
+
+// Close stops the TTL updates and deregisters the proxy service.
+func (m *registerMonitor) Close() error {
+	close(m.stopChan)
+	if err := m.client.Agent().ServiceDeregister(m.id); err != nil {
+		return fmt.Errorf("error deregistering proxy %s: %s", m.id, err)
+	}
+	return nil
+}
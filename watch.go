@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"sync"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/connect/proxy"
@@ -11,8 +12,61 @@ import (
 
 type proxyState struct {
 	config    *proxy.Config
-	listener  *proxy.Listener
 	upstreams map[string]*proxy.Listener
+
+	// mu guards listener and listenerEpoch, which are written both by the
+	// background goroutine startPublicListener spawns and by whichever
+	// goroutine is running Proxy.Serve's loop (reconfigureServiceProxy,
+	// teardownServiceProxy).
+	mu sync.Mutex
+
+	listener *proxy.Listener
+
+	// listenerEpoch is bumped every time the public listener is (re)launched
+	// or the proxyState is torn down. The launching goroutine checks it still
+	// matches before assigning listener, so a superseded rebuild can't clobber
+	// or leak past a newer one, and a teardown racing an in-flight rebuild
+	// makes the rebuild abort instead of outliving the proxyState.
+	listenerEpoch uint64
+
+	// listenerLive is 1 while the public listener's Serve() is actually
+	// running and 0 once it returns (including a bind/accept failure), read
+	// and written atomically since it's touched from its own goroutine.
+	listenerLive int32
+}
+
+// bumpListenerEpoch invalidates any public listener rebuild currently in
+// flight for this state and returns the new epoch.
+func (s *proxyState) bumpListenerEpoch() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listenerEpoch++
+	return s.listenerEpoch
+}
+
+// setListenerIfCurrent assigns l as the state's public listener, unless the
+// epoch was bumped again since epoch was obtained (i.e. this rebuild was
+// superseded or the state was torn down), in which case it leaves the state
+// untouched and returns false so the caller can close l instead.
+func (s *proxyState) setListenerIfCurrent(l *proxy.Listener, epoch uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listenerEpoch != epoch {
+		return false
+	}
+	s.listener = l
+	return true
+}
+
+// closeListener closes and clears the current public listener, if any.
+func (s *proxyState) closeListener() {
+	s.mu.Lock()
+	l := s.listener
+	s.listener = nil
+	s.mu.Unlock()
+	if l != nil {
+		l.Close()
+	}
 }
 
 type Config struct {
@@ -77,32 +131,43 @@ func (w *NodeServicesConfigWatcher) handler(blockVal watch.BlockingParamVal, val
 			continue
 		}
 
-		cfg := &proxy.Config{
-			ProxiedServiceName:      svc.Proxy.DestinationServiceName,
-			ProxiedServiceNamespace: "default",
-		}
-
 		w.logger.Printf("[WARN] SERVICE: %v", svc.Service)
+		configs[svc.ID] = buildProxyConfig(svc, w.logger)
+	}
+	w.ch <- &Config{
+		proxyConfigs: configs,
+	}
+}
 
-		// TODO: telemetry
-		// TODO: custom config (to parse it we need to base64.StdEncoding.DecodeString)
+// buildProxyConfig turns a single Connect proxy service registration into a
+// *proxy.Config, applying conoxy's own defaults and any custom config
+// overrides found on svc. It's shared by every ConfigWatcher that sources
+// its configuration from an AgentService.
+func buildProxyConfig(svc *api.AgentService, logger *log.Logger) *proxy.Config {
+	cfg := &proxy.Config{
+		ProxiedServiceName:      svc.Proxy.DestinationServiceName,
+		ProxiedServiceNamespace: "default",
+	}
 
-		cfg.PublicListener.BindAddress = svc.Address
-		cfg.PublicListener.BindPort = svc.Port
-		cfg.PublicListener.LocalServiceAddress = fmt.Sprintf("%s:%d", svc.Proxy.LocalServiceAddress, svc.Proxy.LocalServicePort)
-		plcSetDefaults(&cfg.PublicListener)
+	cfg.PublicListener.BindAddress = svc.Address
+	cfg.PublicListener.BindPort = svc.Port
+	cfg.PublicListener.LocalServiceAddress = fmt.Sprintf("%s:%d", svc.Proxy.LocalServiceAddress, svc.Proxy.LocalServicePort)
+	plcSetDefaults(&cfg.PublicListener)
 
-		for _, u := range svc.Proxy.Upstreams {
-			uc := proxy.UpstreamConfig(u)
-			ucSetDefaults(&uc)
+	for _, u := range svc.Proxy.Upstreams {
+		uc := proxy.UpstreamConfig(u)
+		ucSetDefaults(&uc)
 
-			cfg.Upstreams = append(cfg.Upstreams, uc)
-		}
-		configs[svc.ID] = cfg
+		cfg.Upstreams = append(cfg.Upstreams, uc)
 	}
-	w.ch <- &Config{
-		proxyConfigs: configs,
+
+	custom, err := parseCustomConfig(svc)
+	if err != nil {
+		logger.Printf("[WARN] error parsing custom config for %s: %s", svc.ID, err)
+	} else {
+		mergeCustomConfig(cfg, custom)
 	}
+	return cfg
 }
 
 // Watch implements ConfigWatcher.